@@ -0,0 +1,632 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package acme is a small ACME (RFC 8555) client that provisions and
+// renews TLS certificates on demand via the TLS-ALPN-01 challenge, so a
+// listener never needs a port other than 443 open. It implements just
+// enough of the protocol to drive the happy path against a compliant CA
+// such as Let's Encrypt or a private ACME server.
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// validHostname matches a syntactically valid DNS hostname: dot-separated
+// labels of letters, digits and hyphens. hello.ServerName comes straight
+// off an unauthenticated TLS ClientHello, so it must be checked before
+// it's used as a cache key, a CertStore key, or an ACME identifier.
+var validHostname = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// LetsEncryptDirectory is the production Let's Encrypt ACME directory URL.
+const LetsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+const alpnProto = "acme-tls/1"
+
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// Provider implements rproxy.CertProvider, issuing and renewing
+// certificates from an ACME CA on demand and caching them in memory and in
+// its CertStore.
+type Provider struct {
+	directoryURL string
+	store        CertStore
+	client       *http.Client
+
+	accountKey *ecdsa.PrivateKey
+	kid        string // account URL, used as the JWS "kid" once registered
+
+	dir directory
+
+	mu         sync.Mutex
+	nonce      string
+	cache      map[string]*tls.Certificate // issued certs, keyed by hostname
+	challenges map[string]*tls.Certificate // in-flight tls-alpn-01 responses, keyed by hostname
+	renewing   map[string]bool
+	inflight   map[string]*obtainCall // in-progress obtain() calls, keyed by hostname
+
+	stopOnce sync.Once
+	done     chan struct{} // closed by Stop to cancel pending renewal goroutines
+}
+
+// obtainCall lets concurrent EnsureCertificate callers for the same
+// never-before-seen hostname share a single obtain() instead of each
+// racing their own ACME order (and clobbering each other's pending
+// tls-alpn-01 challenge cert via obtain's deferred cleanup).
+type obtainCall struct {
+	wg   sync.WaitGroup
+	cert *tls.Certificate
+	err  error
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// NewProvider creates a Provider that issues certificates from the ACME
+// server at directoryURL, persisting them to store. It registers a fresh
+// ACME account on first use.
+func NewProvider(directoryURL string, store CertStore) (*Provider, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{
+		directoryURL: directoryURL,
+		store:        store,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		accountKey:   key,
+		cache:        make(map[string]*tls.Certificate),
+		challenges:   make(map[string]*tls.Certificate),
+		renewing:     make(map[string]bool),
+		inflight:     make(map[string]*obtainCall),
+		done:         make(chan struct{}),
+	}
+	resp, err := p.client.Get(directoryURL)
+	if err != nil {
+		return nil, fmt.Errorf("acme: fetch directory: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&p.dir); err != nil {
+		return nil, fmt.Errorf("acme: decode directory: %w", err)
+	}
+	if err := p.register(); err != nil {
+		return nil, fmt.Errorf("acme: register account: %w", err)
+	}
+	return p, nil
+}
+
+// ALPNProtos reports the ALPN protocol IDs the TLS listener must be
+// willing to negotiate so tls-alpn-01 challenge connections complete.
+func (p *Provider) ALPNProtos() []string { return []string{alpnProto} }
+
+// GetCertificate implements tls.Config.GetCertificate (and
+// rproxy.CertProvider). It serves the in-progress challenge certificate
+// when the ClientHello is a tls-alpn-01 validation request, otherwise the
+// cached or freshly issued certificate for the requested SNI.
+func (p *Provider) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+	if name == "" {
+		return nil, errors.New("acme: client did not send SNI")
+	}
+	if !validHostname.MatchString(name) {
+		return nil, fmt.Errorf("acme: invalid SNI hostname %q", name)
+	}
+	for _, proto := range hello.SupportedProtos {
+		if proto == alpnProto {
+			p.mu.Lock()
+			cert := p.challenges[name]
+			p.mu.Unlock()
+			if cert == nil {
+				return nil, fmt.Errorf("acme: no pending tls-alpn-01 challenge for %q", name)
+			}
+			return cert, nil
+		}
+	}
+	return p.EnsureCertificate(name)
+}
+
+// EnsureCertificate returns a cached certificate for name, obtaining and
+// caching one from the ACME CA if necessary, and starts a background
+// renewal loop for it.
+func (p *Provider) EnsureCertificate(name string) (*tls.Certificate, error) {
+	p.mu.Lock()
+	cert := p.cache[name]
+	p.mu.Unlock()
+	if cert != nil {
+		return cert, nil
+	}
+
+	if stored, err := p.store.Get(name); err == nil {
+		p.mu.Lock()
+		p.cache[name] = stored
+		p.mu.Unlock()
+		p.startRenewal(name, stored)
+		return stored, nil
+	}
+
+	cert, err := p.obtainOnce(name)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.cache[name] = cert
+	p.mu.Unlock()
+	if err := p.store.Put(name, cert); err != nil {
+		log.Printf("acme: store certificate for %q: %v\n", name, err)
+	}
+	p.startRenewal(name, cert)
+	return cert, nil
+}
+
+// obtainOnce ensures at most one ACME order is in flight for name at a
+// time. Without this, a burst of concurrent connections for a hostname
+// that isn't cached yet would each call obtain, and whichever finished
+// first would delete the others' still-pending tls-alpn-01 challenge cert
+// (obtain's challenges[name] is keyed only by hostname), failing their
+// validation and burning extra ACME orders.
+func (p *Provider) obtainOnce(name string) (*tls.Certificate, error) {
+	p.mu.Lock()
+	if call, ok := p.inflight[name]; ok {
+		p.mu.Unlock()
+		call.wg.Wait()
+		return call.cert, call.err
+	}
+	call := &obtainCall{}
+	call.wg.Add(1)
+	p.inflight[name] = call
+	p.mu.Unlock()
+
+	call.cert, call.err = p.obtain(name)
+
+	p.mu.Lock()
+	delete(p.inflight, name)
+	p.mu.Unlock()
+	call.wg.Done()
+
+	return call.cert, call.err
+}
+
+// Stop cancels every pending renewal goroutine started by startRenewal.
+// It does not affect in-flight ACME calls (obtain/obtainOnce) that have
+// already begun. Safe to call more than once or concurrently with
+// EnsureCertificate; once called, no future renewal will fire.
+func (p *Provider) Stop() {
+	p.stopOnce.Do(func() { close(p.done) })
+}
+
+// startRenewal launches (once per name) a goroutine that re-obtains the
+// certificate at 2/3 of its lifetime. The goroutine exits without
+// renewing if Stop is called first, so a Provider dropped by a config
+// reload (Server.apply) doesn't keep firing ACME orders and CertStore
+// writes for hostnames nobody serves anymore.
+func (p *Provider) startRenewal(name string, cert *tls.Certificate) {
+	p.mu.Lock()
+	if p.renewing[name] {
+		p.mu.Unlock()
+		return
+	}
+	p.renewing[name] = true
+	p.mu.Unlock()
+
+	leaf := cert.Leaf
+	if leaf == nil && len(cert.Certificate) > 0 {
+		leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if leaf == nil {
+		return
+	}
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	renewAt := leaf.NotBefore.Add(lifetime * 2 / 3)
+	delay := time.Until(renewAt)
+	if delay < 0 {
+		delay = time.Minute
+	}
+
+	go func() {
+		select {
+		case <-time.After(delay):
+		case <-p.done:
+			return
+		}
+		fresh, err := p.obtain(name)
+		p.mu.Lock()
+		p.renewing[name] = false
+		p.mu.Unlock()
+		if err != nil {
+			log.Printf("acme: renew %q: %v\n", name, err)
+			return
+		}
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+		p.mu.Lock()
+		p.cache[name] = fresh
+		p.mu.Unlock()
+		if err := p.store.Put(name, fresh); err != nil {
+			log.Printf("acme: store renewed certificate for %q: %v\n", name, err)
+		}
+		p.startRenewal(name, fresh)
+	}()
+}
+
+func marshalPrivateKey(key interface{}) ([]byte, error) {
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("acme: unsupported private key type %T", key)
+	}
+	return x509.MarshalECPrivateKey(ecKey)
+}
+
+func pemCertChain(der [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, b := range der {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	}
+	return buf.Bytes()
+}
+
+// jwk returns the account key's public JWK, sent in the protected header
+// of requests made before the account is registered; keyAuthorization
+// hashes its RFC 7638 canonical form into the thumbprint.
+func (p *Provider) jwk() map[string]string {
+	x := p.accountKey.PublicKey.X.FillBytes(make([]byte, 32))
+	y := p.accountKey.PublicKey.Y.FillBytes(make([]byte, 32))
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   base64.RawURLEncoding.EncodeToString(x),
+		"y":   base64.RawURLEncoding.EncodeToString(y),
+	}
+}
+
+func (p *Provider) keyAuthorization(token string) (string, error) {
+	jwk := p.jwk()
+	// RFC 7638 canonical JSON: lexicographically sorted member names.
+	canon := fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, jwk["crv"], jwk["kty"], jwk["x"], jwk["y"])
+	sum := sha256.Sum256([]byte(canon))
+	thumbprint := base64.RawURLEncoding.EncodeToString(sum[:])
+	return token + "." + thumbprint, nil
+}
+
+func b64(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// sign builds and POSTs a JWS-wrapped request to url. payload is nil for
+// POST-as-GET requests. The decoded response body is stored in out (if
+// non-nil) and the response itself is returned so callers can inspect
+// headers such as Location and Replay-Nonce.
+func (p *Provider) sign(url string, payload interface{}, out interface{}) (*http.Response, error) {
+	nonce, err := p.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+	if p.kid != "" {
+		protected["kid"] = p.kid
+	} else {
+		protected["jwk"] = p.jwk()
+	}
+	protectedB64, err := b64(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	var payloadB64 string
+	if payload != nil {
+		payloadB64, err = b64(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hash := sha256.Sum256([]byte(protectedB64 + "." + payloadB64))
+	r, s, err := ecdsa.Sign(rand.Reader, p.accountKey, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+
+	body, err := json.Marshal(map[string]string{
+		"protected": protectedB64,
+		"payload":   payloadB64,
+		"signature": base64.RawURLEncoding.EncodeToString(sig),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.Post(url, "application/jose+json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if n := resp.Header.Get("Replay-Nonce"); n != "" {
+		p.mu.Lock()
+		p.nonce = n
+		p.mu.Unlock()
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp, fmt.Errorf("acme: %s: %s: %s", url, resp.Status, data)
+	}
+	if out != nil {
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, err
+		}
+	}
+	return resp, nil
+}
+
+func (p *Provider) nextNonce() (string, error) {
+	p.mu.Lock()
+	nonce := p.nonce
+	p.nonce = ""
+	p.mu.Unlock()
+	if nonce != "" {
+		return nonce, nil
+	}
+	resp, err := p.client.Head(p.dir.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce = resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("acme: server did not return a nonce")
+	}
+	return nonce, nil
+}
+
+func (p *Provider) register() error {
+	payload := map[string]interface{}{"termsOfServiceAgreed": true}
+	resp, err := p.sign(p.dir.NewAccount, payload, nil)
+	if err != nil {
+		return err
+	}
+	p.kid = resp.Header.Get("Location")
+	if p.kid == "" {
+		return errors.New("acme: account registration did not return a Location")
+	}
+	return nil
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type authorization struct {
+	Status     string      `json:"status"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
+// obtain runs a full ACME order for name via TLS-ALPN-01 and returns the
+// issued certificate.
+func (p *Provider) obtain(name string) (*tls.Certificate, error) {
+	var ord order
+	payload := map[string]interface{}{
+		"identifiers": []map[string]string{{"type": "dns", "value": name}},
+	}
+	resp, err := p.sign(p.dir.NewOrder, payload, &ord)
+	if err != nil {
+		return nil, err
+	}
+	orderURL := resp.Header.Get("Location")
+	if len(ord.Authorizations) != 1 {
+		return nil, fmt.Errorf("acme: expected one authorization for %q, got %d", name, len(ord.Authorizations))
+	}
+
+	var authz authorization
+	if _, err := p.sign(ord.Authorizations[0], nil, &authz); err != nil {
+		return nil, err
+	}
+	var ch *challenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == "tls-alpn-01" {
+			ch = &authz.Challenges[i]
+			break
+		}
+	}
+	if ch == nil {
+		return nil, fmt.Errorf("acme: CA did not offer a tls-alpn-01 challenge for %q", name)
+	}
+
+	keyAuth, err := p.keyAuthorization(ch.Token)
+	if err != nil {
+		return nil, err
+	}
+	challengeCert, err := selfSignedChallengeCert(name, keyAuth)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.challenges[name] = challengeCert
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.challenges, name)
+		p.mu.Unlock()
+	}()
+
+	if _, err := p.sign(ch.URL, map[string]string{}, nil); err != nil {
+		return nil, err
+	}
+	if err := p.pollStatus(ord.Authorizations[0], &authz.Status); err != nil {
+		return nil, err
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, leafKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.sign(ord.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csrDER)}, &ord); err != nil {
+		return nil, err
+	}
+	if err := p.pollOrder(orderURL, &ord); err != nil {
+		return nil, err
+	}
+
+	certResp, err := p.sign(ord.Certificate, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer certResp.Body.Close()
+	chainPEM, err := ioutil.ReadAll(certResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var der [][]byte
+	rest := chainPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		der = append(der, block.Bytes)
+	}
+	if len(der) == 0 {
+		return nil, fmt.Errorf("acme: empty certificate chain for %q", name)
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: leafKey, Leaf: leaf}, nil
+}
+
+// pollStatus repeatedly re-fetches an authorization until its status is
+// "valid" or "invalid", giving up after 20 attempts.
+func (p *Provider) pollStatus(url string, status *string) error {
+	for i := 0; i < 20; i++ {
+		var authz authorization
+		if _, err := p.sign(url, nil, &authz); err != nil {
+			return err
+		}
+		*status = authz.Status
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "invalid":
+			return fmt.Errorf("acme: authorization %s became invalid", url)
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return fmt.Errorf("acme: authorization %s did not complete in time", url)
+}
+
+// pollOrder repeatedly re-fetches the order at orderURL (its own Location,
+// returned when it was created) until its status is "valid" or "invalid",
+// giving up after 20 attempts.
+func (p *Provider) pollOrder(orderURL string, ord *order) error {
+	for i := 0; i < 20; i++ {
+		switch ord.Status {
+		case "valid":
+			return nil
+		case "invalid":
+			return fmt.Errorf("acme: order became invalid")
+		}
+		time.Sleep(2 * time.Second)
+		if _, err := p.sign(orderURL, nil, ord); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("acme: order did not finalize in time")
+}
+
+// selfSignedChallengeCert builds the self-signed certificate required by
+// RFC 8737 section 3: a single SAN of name and a critical
+// id-pe-acmeIdentifier extension holding SHA-256(key authorization).
+func selfSignedChallengeCert(name, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	extValue, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 160))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{
+			Id:       oidACMEIdentifier,
+			Critical: true,
+			Value:    extValue,
+		}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acme
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// sanitizeName rejects anything that isn't a single path element, so a
+// hostname string (ultimately attacker-controlled: it comes from an
+// unauthenticated TLS ClientHello's SNI) can't walk certPath/keyPath
+// outside Dir via "../" or an absolute path.
+func sanitizeName(name string) error {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return fmt.Errorf("acme: invalid certificate name %q", name)
+	}
+	return nil
+}
+
+// CertStore persists issued certificate+key pairs between runs, keyed by
+// hostname, so a restart doesn't force re-issuance against the ACME rate
+// limits. Implementations must be safe for concurrent use.
+type CertStore interface {
+	Get(name string) (*tls.Certificate, error)
+	Put(name string, cert *tls.Certificate) error
+}
+
+// ErrNotFound is returned by CertStore.Get when no certificate is stored
+// for the given name.
+var ErrNotFound = fmt.Errorf("acme: certificate not found in store")
+
+// FileCertStore is the default CertStore, keeping one "<name>.crt" /
+// "<name>.key" PEM pair per hostname under Dir.
+type FileCertStore struct {
+	Dir string
+}
+
+func (s *FileCertStore) Get(name string) (*tls.Certificate, error) {
+	if err := sanitizeName(name); err != nil {
+		return nil, err
+	}
+	certPath := filepath.Join(s.Dir, name+".crt")
+	keyPath := filepath.Join(s.Dir, name+".key")
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (s *FileCertStore) Put(name string, cert *tls.Certificate) error {
+	if err := sanitizeName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := marshalPrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := ioutil.WriteFile(filepath.Join(s.Dir, name+".crt"), certPEM, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.Dir, name+".key"), keyPEM, 0600)
+}
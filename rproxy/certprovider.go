@@ -0,0 +1,53 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rproxy
+
+import "crypto/tls"
+
+// CertProvider supplies the certificate a TLS listener presents for a
+// given ClientHello. It has the same signature as tls.Config.GetCertificate
+// so an implementation can be plugged in directly; see WithCertProvider.
+// The default, used when no provider is configured, loads the fixed
+// serverCert/serverKey pair passed to NewRProxy. rproxy/acme.Provider is
+// an alternative that issues certificates from an ACME CA on demand.
+type CertProvider interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// FileCertProvider serves a single certificate loaded once from a PEM
+// file pair, regardless of the requested SNI.
+type FileCertProvider struct {
+	cert tls.Certificate
+}
+
+// NewFileCertProvider loads certFile/keyFile once and returns a
+// CertProvider that always serves that certificate.
+func NewFileCertProvider(certFile, keyFile string) (*FileCertProvider, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &FileCertProvider{cert: cert}, nil
+}
+
+func (p *FileCertProvider) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return &p.cert, nil
+}
+
+// WithCertProvider overrides the certificate source for a TLS listener,
+// e.g. with an rproxy/acme.Provider for automatic ACME provisioning.
+func WithCertProvider(provider CertProvider) Option {
+	return func(rp *RProxy) { rp.certProvider = provider }
+}
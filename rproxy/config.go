@@ -0,0 +1,175 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rproxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FrontendConfig declares one rproxy listener: where it listens, how it
+// terminates (or doesn't terminate) TLS, and where it sends traffic.
+// Mode selects which NewRProxy-family constructor Server uses to build it:
+// "tcp" and "tls" map to NewRProxy, "sni" to NewSNIRProxy, "mitm" to
+// NewMITMRProxy.
+type FrontendConfig struct {
+	Name   string
+	Listen string
+	Mode   string // tcp, tls, sni, mitm
+
+	BackendProto string
+	Backend      string
+
+	RootCert   string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+
+	// RouterConfig is the routing rules file for mode "sni".
+	RouterConfig string
+
+	// ACMEDirectory and ACMECertDir configure automatic certificate
+	// provisioning for mode "tls"; ACMEDirectory is empty unless ACME is
+	// in use.
+	ACMEDirectory string
+	ACMECertDir   string
+	ManagedNames  []string
+
+	// CACert, CAKey and BackendPort configure mode "mitm".
+	CACert      string
+	CAKey       string
+	BackendPort string
+
+	AcceptProxyProto bool
+	SendProxyProto   bool
+	ProxyProtoTLVs   bool
+}
+
+// Config is the parsed form of an rproxy config file: a declarative list
+// of frontends, each built and managed independently by a Server.
+type Config struct {
+	Frontends []FrontendConfig
+}
+
+// LoadConfig reads a declarative rproxy config file. The format is a
+// series of scfg-style blocks:
+//
+//	frontend <name> {
+//		listen <addr>
+//		mode tcp|tls|sni|mitm
+//		backend <proto> <addr>
+//		...
+//	}
+//
+// Lines starting with '#' and blank lines are ignored.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg Config
+	var cur *FrontendConfig
+	lineNo := 0
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if cur == nil {
+			fields := strings.Fields(line)
+			if len(fields) != 3 || fields[0] != "frontend" || fields[2] != "{" {
+				return nil, fmt.Errorf("%s:%d: expected \"frontend <name> {\"", path, lineNo)
+			}
+			cur = &FrontendConfig{Name: fields[1]}
+			continue
+		}
+
+		if line == "}" {
+			cfg.Frontends = append(cfg.Frontends, *cur)
+			cur = nil
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: malformed directive %q", path, lineNo, line)
+		}
+		key, args := fields[0], fields[1:]
+
+		switch key {
+		case "listen":
+			cur.Listen = args[0]
+		case "mode":
+			cur.Mode = args[0]
+		case "backend":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("%s:%d: backend needs a protocol and an address", path, lineNo)
+			}
+			cur.BackendProto, cur.Backend = args[0], args[1]
+		case "root_cert":
+			cur.RootCert = args[0]
+		case "server_cert":
+			cur.ServerCert = args[0]
+		case "server_key":
+			cur.ServerKey = args[0]
+		case "client_cert":
+			cur.ClientCert = args[0]
+		case "client_key":
+			cur.ClientKey = args[0]
+		case "router_config":
+			cur.RouterConfig = args[0]
+		case "acme_directory":
+			cur.ACMEDirectory = args[0]
+		case "acme_cert_dir":
+			cur.ACMECertDir = args[0]
+		case "managed_name":
+			cur.ManagedNames = append(cur.ManagedNames, args[0])
+		case "ca_cert":
+			cur.CACert = args[0]
+		case "ca_key":
+			cur.CAKey = args[0]
+		case "backend_port":
+			cur.BackendPort = args[0]
+		case "accept_proxy_proto":
+			cur.AcceptProxyProto, err = strconv.ParseBool(args[0])
+		case "send_proxy_proto":
+			cur.SendProxyProto, err = strconv.ParseBool(args[0])
+		case "proxy_proto_tlvs":
+			cur.ProxyProtoTLVs, err = strconv.ParseBool(args[0])
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown directive %q", path, lineNo, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if cur != nil {
+		return nil, fmt.Errorf("%s: frontend %q missing closing \"}\"", path, cur.Name)
+	}
+	return &cfg, nil
+}
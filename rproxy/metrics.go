@@ -0,0 +1,208 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rproxy
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxSNIMetrics bounds how many distinct SNI hostnames perSNI tracks at
+// once. perSNI is keyed by SNI values that never need to be legitimate or
+// unique (an attacker can send
+// an arbitrary string per connection), so without a cap the map would grow
+// without bound.
+const maxSNIMetrics = 4096
+
+// Metrics is a small Prometheus-style registry for everything an RProxy
+// fleet wants observed in production: accepted connections, TLS
+// handshake failures, byte totals, backend dial latency, and per-SNI
+// connection counts. Every counter method is safe for concurrent use.
+// See WithMetrics and ListenAdmin.
+type Metrics struct {
+	acceptedConns     uint64
+	handshakeFailures uint64
+	bytesIn           uint64
+	bytesOut          uint64
+	dialCount         uint64
+	dialTotalNanos    uint64
+
+	mu      sync.Mutex
+	perSNI  map[string]uint64
+	sniLRU  *list.List // of string hostnames, most-recently-used at the front
+	sniElem map[string]*list.Element
+}
+
+// NewMetrics returns an empty Metrics registry.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		perSNI:  make(map[string]uint64),
+		sniLRU:  list.New(),
+		sniElem: make(map[string]*list.Element),
+	}
+}
+
+func (m *Metrics) IncAccepted()         { atomic.AddUint64(&m.acceptedConns, 1) }
+func (m *Metrics) IncHandshakeFailure() { atomic.AddUint64(&m.handshakeFailures, 1) }
+
+// AddBytes records bytes copied from the client to the backend (in) and
+// from the backend to the client (out) for one connection.
+func (m *Metrics) AddBytes(in, out uint64) {
+	atomic.AddUint64(&m.bytesIn, in)
+	atomic.AddUint64(&m.bytesOut, out)
+}
+
+// ObserveDialLatency records how long one backend dial took.
+func (m *Metrics) ObserveDialLatency(d time.Duration) {
+	atomic.AddUint64(&m.dialCount, 1)
+	atomic.AddUint64(&m.dialTotalNanos, uint64(d.Nanoseconds()))
+}
+
+// IncSNIConn counts one more connection for the given SNI hostname; it is
+// a no-op if name is empty (plain TCP/TLS listeners have none). Tracked
+// hostnames are kept in an LRU of at most maxSNIMetrics entries, evicting
+// the least-recently-seen one so an attacker sending many distinct bogus
+// SNI values can't grow perSNI without bound.
+func (m *Metrics) IncSNIConn(name string) {
+	if name == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.perSNI[name]++
+	if elem, ok := m.sniElem[name]; ok {
+		m.sniLRU.MoveToFront(elem)
+		return
+	}
+	m.sniElem[name] = m.sniLRU.PushFront(name)
+	for m.sniLRU.Len() > maxSNIMetrics {
+		oldest := m.sniLRU.Back()
+		m.sniLRU.Remove(oldest)
+		evicted := oldest.Value.(string)
+		delete(m.sniElem, evicted)
+		delete(m.perSNI, evicted)
+	}
+}
+
+// ServeHTTP renders the registry in Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP rproxy_accepted_connections_total Connections accepted by all listeners.")
+	fmt.Fprintln(w, "# TYPE rproxy_accepted_connections_total counter")
+	fmt.Fprintf(w, "rproxy_accepted_connections_total %d\n", atomic.LoadUint64(&m.acceptedConns))
+
+	fmt.Fprintln(w, "# HELP rproxy_handshake_failures_total TLS handshakes that failed.")
+	fmt.Fprintln(w, "# TYPE rproxy_handshake_failures_total counter")
+	fmt.Fprintf(w, "rproxy_handshake_failures_total %d\n", atomic.LoadUint64(&m.handshakeFailures))
+
+	fmt.Fprintln(w, "# HELP rproxy_bytes_in_total Bytes copied from clients to backends.")
+	fmt.Fprintln(w, "# TYPE rproxy_bytes_in_total counter")
+	fmt.Fprintf(w, "rproxy_bytes_in_total %d\n", atomic.LoadUint64(&m.bytesIn))
+
+	fmt.Fprintln(w, "# HELP rproxy_bytes_out_total Bytes copied from backends to clients.")
+	fmt.Fprintln(w, "# TYPE rproxy_bytes_out_total counter")
+	fmt.Fprintf(w, "rproxy_bytes_out_total %d\n", atomic.LoadUint64(&m.bytesOut))
+
+	fmt.Fprintln(w, "# HELP rproxy_backend_dials_total Backend dials attempted.")
+	fmt.Fprintln(w, "# TYPE rproxy_backend_dials_total counter")
+	fmt.Fprintf(w, "rproxy_backend_dials_total %d\n", atomic.LoadUint64(&m.dialCount))
+
+	fmt.Fprintln(w, "# HELP rproxy_backend_dial_seconds_total Cumulative backend dial latency.")
+	fmt.Fprintln(w, "# TYPE rproxy_backend_dial_seconds_total counter")
+	fmt.Fprintf(w, "rproxy_backend_dial_seconds_total %f\n", time.Duration(atomic.LoadUint64(&m.dialTotalNanos)).Seconds())
+
+	m.mu.Lock()
+	names := make([]string, 0, len(m.perSNI))
+	for name := range m.perSNI {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "# HELP rproxy_sni_connections_total Connections seen per SNI hostname.")
+	fmt.Fprintln(w, "# TYPE rproxy_sni_connections_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "rproxy_sni_connections_total{sni=%q} %d\n", name, m.perSNI[name])
+	}
+	m.mu.Unlock()
+}
+
+// ListenAdmin starts an HTTP server on addr exposing m at /metrics. Like
+// http.ListenAndServe, it blocks, so callers typically run it in its own
+// goroutine.
+func (m *Metrics) ListenAdmin(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	return http.ListenAndServe(addr, mux)
+}
+
+// WithMetrics records connection and byte counters to m.
+func WithMetrics(m *Metrics) Option {
+	return func(rp *RProxy) { rp.metrics = m }
+}
+
+// WithLogger replaces the default JSONLogger used to emit one record per
+// closed connection.
+func WithLogger(l Logger) Option {
+	return func(rp *RProxy) { rp.logger = l }
+}
+
+// ConnRecord summarizes one connection RProxy finished serving, for
+// Logger.
+type ConnRecord struct {
+	ClientAddr  string        `json:"client_addr"`
+	SNI         string        `json:"sni,omitempty"`
+	ALPN        string        `json:"alpn,omitempty"`
+	Cipher      string        `json:"cipher,omitempty"`
+	BackendAddr string        `json:"backend_addr"`
+	Duration    time.Duration `json:"duration"`
+	BytesUp     uint64        `json:"bytes_up"`
+	BytesDown   uint64        `json:"bytes_down"`
+	CloseReason string        `json:"close_reason"`
+}
+
+// Logger receives one ConnRecord each time RProxy finishes serving a
+// connection.
+type Logger interface {
+	LogConn(ConnRecord)
+}
+
+// JSONLogger is the default Logger: one JSON object per line, written to
+// Output (os.Stdout if nil).
+type JSONLogger struct {
+	Output io.Writer
+}
+
+func (l *JSONLogger) LogConn(rec ConnRecord) {
+	out := l.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("JSONLogger: marshal conn record (%v)\n", err)
+		return
+	}
+	out.Write(append(data, '\n'))
+}
@@ -0,0 +1,320 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rproxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Interceptor is called once per intercepted HTTP message in "mitm" mode,
+// with the dumped request bytes on req, the dumped response bytes on
+// resp, and the other argument nil.
+type Interceptor func(req, resp []byte)
+
+// MITMCertProvider mints a leaf certificate for each requested SNI
+// hostname on the fly, signed by a user-supplied CA, and caches leaves in
+// an LRU keyed by hostname so repeat connections to the same host don't
+// re-sign a certificate (mirrors hetty's CertConfig).
+type MITMCertProvider struct {
+	ca       tls.Certificate
+	caLeaf   *x509.Certificate
+	capacity int
+
+	mu    sync.Mutex
+	lru   *list.List // of *mitmCacheEntry, most-recently-used at the front
+	index map[string]*list.Element
+}
+
+type mitmCacheEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+// NewMITMCertProvider loads a CA certificate+key pair and returns a
+// CertProvider that mints and caches per-hostname leaves signed by it.
+// capacity bounds how many leaves are kept in memory before the
+// least-recently-used one is evicted.
+func NewMITMCertProvider(caCertFile, caKeyFile string, capacity int) (*MITMCertProvider, error) {
+	ca, err := tls.LoadX509KeyPair(caCertFile, caKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	caLeaf, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if capacity <= 0 {
+		capacity = 1024
+	}
+	return &MITMCertProvider{
+		ca:       ca,
+		caLeaf:   caLeaf,
+		capacity: capacity,
+		lru:      list.New(),
+		index:    make(map[string]*list.Element),
+	}, nil
+}
+
+// GetCertificate implements CertProvider, minting a new leaf for
+// hello.ServerName on a cache miss.
+func (p *MITMCertProvider) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := hello.ServerName
+	if host == "" {
+		host = hello.Conn.LocalAddr().String()
+	}
+
+	p.mu.Lock()
+	if elem, ok := p.index[host]; ok {
+		p.lru.MoveToFront(elem)
+		cert := elem.Value.(*mitmCacheEntry).cert
+		p.mu.Unlock()
+		return cert, nil
+	}
+	p.mu.Unlock()
+
+	cert, err := p.mintLeaf(host)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elem := p.lru.PushFront(&mitmCacheEntry{host: host, cert: cert})
+	p.index[host] = elem
+	for p.lru.Len() > p.capacity {
+		oldest := p.lru.Back()
+		p.lru.Remove(oldest)
+		delete(p.index, oldest.Value.(*mitmCacheEntry).host)
+	}
+	return cert, nil
+}
+
+func (p *MITMCertProvider) mintLeaf(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial := make([]byte, 20)
+	if _, err := rand.Read(serial); err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(serial),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.caLeaf, &key.PublicKey, p.ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, p.ca.Certificate[0]}, PrivateKey: key}, nil
+}
+
+// NewMITMRProxy creates an RProxy that terminates client TLS with a
+// freshly minted, CA-signed leaf certificate, dials the real backend as a
+// TLS client using the SNI hostname the client asked for (on
+// backendPort), and pipes the two decrypted streams. HTTP/1.1 traffic is
+// parsed request by request so interceptor, when non-nil, can observe each
+// request/response pair; any other traffic is spliced through raw.
+func NewMITMRProxy(listenAddr, backendPort, caCertFile, caKeyFile string, interceptor Interceptor, opts ...Option) (*RProxy, error) {
+	ca, err := NewMITMCertProvider(caCertFile, caKeyFile, 1024)
+	if err != nil {
+		return nil, err
+	}
+	if backendPort == "" {
+		backendPort = "443"
+	}
+	rp := &RProxy{
+		listenProto:     "mitm",
+		listenAddr:      listenAddr,
+		mitmCA:          ca,
+		mitmBackendPort: backendPort,
+		Interceptor:     interceptor,
+	}
+	for _, opt := range opts {
+		opt(rp)
+	}
+	return rp, nil
+}
+
+func (rp *RProxy) startMITM() error {
+	lAddr, err := net.ResolveTCPAddr("tcp", rp.listenAddr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.ListenTCP("tcp", lAddr)
+	if err != nil {
+		return err
+	}
+	return rp.acceptLoop(ln, func(conn net.Conn) {
+		rp.acceptMITM(conn)
+	})
+}
+
+func (rp *RProxy) acceptMITM(rawConn net.Conn) {
+	start := time.Now()
+	config := &tls.Config{GetCertificate: rp.mitmCA.GetCertificate}
+	clientConn := tls.Server(rawConn, config)
+	if err := clientConn.Handshake(); err != nil {
+		log.Printf("mitm: client handshake error (%v)\n", err)
+		if rp.metrics != nil {
+			rp.metrics.IncHandshakeFailure()
+		}
+		clientConn.Close()
+		return
+	}
+
+	host := clientConn.ConnectionState().ServerName
+	if host == "" {
+		log.Printf("mitm: client sent no SNI\n")
+		clientConn.Close()
+		return
+	}
+	if rp.metrics != nil {
+		rp.metrics.IncSNIConn(host)
+	}
+
+	backendAddr := net.JoinHostPort(host, rp.mitmBackendPort)
+	dialStart := time.Now()
+	backendConn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", backendAddr, &tls.Config{ServerName: host})
+	if rp.metrics != nil {
+		rp.metrics.ObserveDialLatency(time.Since(dialStart))
+	}
+	if err != nil {
+		log.Printf("mitm: dial backend %q (%v)\n", backendAddr, err)
+		clientConn.Close()
+		return
+	}
+
+	state := clientConn.ConnectionState()
+	bytesUp, bytesDown := rp.serveMITM(clientConn, backendConn)
+	rp.logClose(clientConn, host, state.NegotiatedProtocol, tls.CipherSuiteName(state.CipherSuite),
+		backendAddr, time.Since(start), bytesUp, bytesDown, "closed")
+}
+
+// countConn wraps a net.Conn to track bytes read from and written to it,
+// so serveMITM can report byte totals the same way serveTCP/serveTLS/
+// serveSNI do via pipe, even though its HTTP path doesn't go through
+// io.Copy.
+type countConn struct {
+	net.Conn
+	read, written uint64
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.read, uint64(n))
+	return n, err
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+// httpMethodPrefixes are the request lines serveMITM recognizes as HTTP/1.1
+// traffic worth parsing; anything else is spliced through raw.
+var httpMethodPrefixes = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("HEAD "), []byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "),
+	[]byte("CONNECT "),
+}
+
+func looksLikeHTTP(prefix []byte) bool {
+	for _, m := range httpMethodPrefixes {
+		if bytes.HasPrefix(prefix, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveMITM pipes the decrypted client and backend streams, returning the
+// bytes copied in each direction so acceptMITM can report them the same
+// way the other listen modes do. When the first bytes look like an
+// HTTP/1.1 request line, request/response pairs are parsed so
+// rp.Interceptor can observe them; otherwise the streams are spliced
+// through unmodified.
+func (rp *RProxy) serveMITM(clientConn, backendConn net.Conn) (bytesUp, bytesDown uint64) {
+	cc := &countConn{Conn: clientConn}
+	bc := &countConn{Conn: backendConn}
+
+	clientReader := bufio.NewReader(cc)
+	prefix, _ := clientReader.Peek(8)
+	if !looksLikeHTTP(prefix) {
+		bytesUp, bytesDown, _ = rp.pipe(bc, cc, clientReader)
+		return bytesUp, bytesDown
+	}
+	defer cc.Close()
+	defer bc.Close()
+
+	backendReader := bufio.NewReader(bc)
+	for {
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			break
+		}
+		if rp.Interceptor != nil {
+			if dump, err := httputil.DumpRequest(req, true); err == nil {
+				rp.Interceptor(dump, nil)
+			}
+		}
+		if err := req.Write(bc); err != nil {
+			break
+		}
+
+		resp, err := http.ReadResponse(backendReader, req)
+		if err != nil {
+			break
+		}
+		if rp.Interceptor != nil {
+			if dump, err := httputil.DumpResponse(resp, true); err == nil {
+				rp.Interceptor(nil, dump)
+			}
+		}
+		err = resp.Write(cc)
+		resp.Body.Close()
+		if err != nil {
+			break
+		}
+	}
+
+	bytesUp, bytesDown = atomic.LoadUint64(&bc.written), atomic.LoadUint64(&cc.written)
+	if rp.metrics != nil {
+		rp.metrics.AddBytes(bytesUp, bytesDown)
+	}
+	return bytesUp, bytesDown
+}
@@ -0,0 +1,294 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol v2 constants, see
+// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+var proxyProtoV2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyProtoVersionCmd   = 0x21 // version 2, command PROXY
+	proxyProtoVersionLocal = 0x20 // version 2, command LOCAL
+	proxyProtoFamilyIPv4   = 0x11 // AF_INET, STREAM
+	proxyProtoFamilyIPv6   = 0x21 // AF_INET6, STREAM
+
+	tlvTypeALPN      = 0x01
+	tlvTypeAuthority = 0x02
+	tlvTypeSSL       = 0x20
+
+	tlvSSLSubtypeVersion = 0x21
+	tlvSSLSubtypeCN      = 0x22
+	tlvSSLSubtypeCipher  = 0x23
+
+	// tlvTypeClientCertFingerprint is a vendor-specific TLV (0xE0-0xEF is
+	// reserved for application use by the spec) carrying the SHA-256
+	// fingerprint of the client's leaf certificate.
+	tlvTypeClientCertFingerprint = 0xE0
+)
+
+var errNotProxyProto = errors.New("rproxy: no PROXY protocol header present")
+
+// Option configures optional RProxy behavior. See WithAcceptProxyProto,
+// WithSendProxyProto and WithProxyProtoTLVs.
+type Option func(*RProxy)
+
+// WithAcceptProxyProto makes the listener expect a PROXY protocol v1 or v2
+// header in front of every accepted connection, so the true client address
+// survives being fronted by an L4 load balancer.
+func WithAcceptProxyProto(accept bool) Option {
+	return func(rp *RProxy) { rp.acceptProxyProto = accept }
+}
+
+// WithSendProxyProto makes rproxy prepend a PROXY protocol v2 header to
+// every backend connection, carrying the original client address.
+func WithSendProxyProto(send bool) Option {
+	return func(rp *RProxy) { rp.sendProxyProto = send }
+}
+
+// WithConnTracker wraps every connection RProxy accepts with track before
+// serving it; Server uses this to maintain its Conns set across reloads
+// and shutdown.
+func WithConnTracker(track func(net.Conn) net.Conn) Option {
+	return func(rp *RProxy) { rp.trackConn = track }
+}
+
+// WithProxyProtoTLVs adds TLS identity TLVs (negotiated cipher, ALPN, and
+// for mTLS listeners, the client certificate CN and fingerprint) to the
+// PROXY v2 header written by WithSendProxyProto.
+func WithProxyProtoTLVs(include bool) Option {
+	return func(rp *RProxy) { rp.proxyProtoTLVs = include }
+}
+
+// peekClientAddr reads an optional PROXY protocol header off r and returns
+// the original client address it describes, plus a *bufio.Reader that
+// continues where the header left off. If r carries no PROXY header,
+// clientAddr is nil and br reads from the start of r unchanged.
+func peekClientAddr(r io.Reader) (clientAddr *net.TCPAddr, br *bufio.Reader, err error) {
+	br = bufio.NewReaderSize(r, 232) // max v2 header size with a full address block
+	prefix, err := br.Peek(12)
+	if err != nil && err != io.EOF {
+		return nil, br, err
+	}
+	if bytes.Equal(prefix, proxyProtoV2Sig) {
+		addr, err := readProxyHeaderV2(br)
+		return addr, br, err
+	}
+	if bytes.HasPrefix(prefix, []byte("PROXY ")) {
+		addr, err := readProxyHeaderV1(br)
+		return addr, br, err
+	}
+	return nil, br, nil
+}
+
+// proxyConn wraps an accepted connection that had its PROXY protocol
+// header peeled off and/or its TLS identity captured, so the backend leg
+// can recover the original client address and TLS state when emitting its
+// own PROXY v2 header (see WithSendProxyProto).
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	clientAddr *net.TCPAddr
+	state      *tls.ConnectionState
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.r != nil {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+// proxyMeta recovers the client address and TLS connection state
+// rproxy learned about listenConn while accepting it, falling back to
+// listenConn's own RemoteAddr when nothing was captured.
+func proxyMeta(listenConn net.Conn) (*net.TCPAddr, *tls.ConnectionState) {
+	if pc, ok := listenConn.(*proxyConn); ok {
+		if pc.clientAddr != nil {
+			return pc.clientAddr, pc.state
+		}
+		addr, _ := pc.Conn.RemoteAddr().(*net.TCPAddr)
+		return addr, pc.state
+	}
+	addr, _ := listenConn.RemoteAddr().(*net.TCPAddr)
+	return addr, nil
+}
+
+func readProxyHeaderV1(br *bufio.Reader) (*net.TCPAddr, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(strings.TrimSpace(line))
+	// PROXY <proto> <src addr> <dst addr> <src port> <dst port>
+	if len(fields) != 6 || fields[0] != "PROXY" {
+		return nil, errNotProxyProto
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("rproxy: bad PROXY v1 source address %q", fields[2])
+	}
+	port, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (*net.TCPAddr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if header[12] != proxyProtoVersionCmd && header[12] != proxyProtoVersionLocal {
+		return nil, fmt.Errorf("rproxy: unsupported PROXY v2 version/command 0x%x", header[12])
+	}
+	addrLen := int(binary.BigEndian.Uint16(header[14:16]))
+	body := make([]byte, addrLen)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	if header[12] == proxyProtoVersionLocal {
+		return nil, nil
+	}
+
+	switch header[13] {
+	case proxyProtoFamilyIPv4:
+		if len(body) < 12 {
+			return nil, errNotProxyProto
+		}
+		srcPort := binary.BigEndian.Uint16(body[8:10])
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(srcPort)}, nil
+	case proxyProtoFamilyIPv6:
+		if len(body) < 36 {
+			return nil, errNotProxyProto
+		}
+		srcPort := binary.BigEndian.Uint16(body[32:34])
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(srcPort)}, nil
+	default:
+		// LOCAL command or unsupported family: no address to recover.
+		return nil, nil
+	}
+}
+
+// writeProxyHeaderV2 prepends a PROXY protocol v2 header describing src and
+// dst to w, optionally followed by TLS identity TLVs.
+func writeProxyHeaderV2(w io.Writer, src, dst *net.TCPAddr, tlvs [][]byte) error {
+	var header bytes.Buffer
+	header.Write(proxyProtoV2Sig)
+	header.WriteByte(proxyProtoVersionCmd)
+
+	var addr bytes.Buffer
+	family := byte(proxyProtoFamilyIPv4)
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		family = proxyProtoFamilyIPv6
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	addr.Write(srcIP)
+	addr.Write(dstIP)
+	binary.Write(&addr, binary.BigEndian, uint16(src.Port))
+	binary.Write(&addr, binary.BigEndian, uint16(dst.Port))
+	for _, tlv := range tlvs {
+		addr.Write(tlv)
+	}
+
+	header.WriteByte(family)
+	binary.Write(&header, binary.BigEndian, uint16(addr.Len()))
+	header.Write(addr.Bytes())
+
+	_, err := w.Write(header.Bytes())
+	return err
+}
+
+func tlv(typ byte, value []byte) []byte {
+	buf := make([]byte, 3+len(value))
+	buf[0] = typ
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(value)))
+	copy(buf[3:], value)
+	return buf
+}
+
+// buildIdentityTLVs assembles the optional TLVs carried in the PROXY v2
+// header: the SNI as the authority TLV, the negotiated ALPN, and a
+// PP2_TYPE_SSL block carrying the cipher and — for mTLS connections — the
+// client certificate's CN. The client certificate's SHA-256 fingerprint
+// goes in its own tlvTypeClientCertFingerprint TLV, outside that block.
+func buildIdentityTLVs(serverName string, state *tls.ConnectionState) [][]byte {
+	var tlvs [][]byte
+	if serverName != "" {
+		tlvs = append(tlvs, tlv(tlvTypeAuthority, []byte(serverName)))
+	}
+	if state == nil {
+		return tlvs
+	}
+	if state.NegotiatedProtocol != "" {
+		tlvs = append(tlvs, tlv(tlvTypeALPN, []byte(state.NegotiatedProtocol)))
+	}
+
+	var ssl bytes.Buffer
+	clientCertPresent := byte(0)
+	if len(state.PeerCertificates) > 0 {
+		clientCertPresent = 1
+	}
+	ssl.WriteByte(clientCertPresent)
+	binary.Write(&ssl, binary.BigEndian, uint32(0)) // verify result: 0 == success
+
+	ssl.Write(tlv(tlvSSLSubtypeCipher, []byte(tls.CipherSuiteName(state.CipherSuite))))
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		ssl.Write(tlv(tlvSSLSubtypeCN, []byte(cert.Subject.CommonName)))
+		fingerprint := sha256.Sum256(cert.Raw)
+		tlvs = append(tlvs, tlv(tlvTypeClientCertFingerprint, fingerprint[:]))
+	}
+	tlvs = append(tlvs, tlv(tlvTypeSSL, ssl.Bytes()))
+	return tlvs
+}
+
+// writeProxyHeader emits a PROXY v2 header onto backendConn describing
+// listenConn's original client address, and — when WithProxyProtoTLVs is
+// set — its SNI, negotiated ALPN/cipher, and client certificate identity.
+func (rp *RProxy) writeProxyHeader(backendConn, listenConn net.Conn, serverName string) error {
+	clientAddr, state := proxyMeta(listenConn)
+	if clientAddr == nil {
+		clientAddr = &net.TCPAddr{}
+	}
+	dstAddr, _ := backendConn.RemoteAddr().(*net.TCPAddr)
+	if dstAddr == nil {
+		dstAddr = &net.TCPAddr{}
+	}
+	if serverName == "" && state != nil {
+		serverName = state.ServerName
+	}
+
+	var tlvs [][]byte
+	if rp.proxyProtoTLVs {
+		tlvs = buildIdentityTLVs(serverName, state)
+	}
+	return writeProxyHeaderV2(backendConn, clientAddr, dstAddr, tlvs)
+}
@@ -0,0 +1,175 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeaderV1Valid(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\nrest"))
+	addr, err := readProxyHeaderV1(br)
+	if err != nil {
+		t.Fatalf("readProxyHeaderV1: %v", err)
+	}
+	if addr.IP.String() != "1.2.3.4" || addr.Port != 1111 {
+		t.Errorf("addr = %+v, want 1.2.3.4:1111", addr)
+	}
+}
+
+func TestReadProxyHeaderV1BadFieldCount(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("PROXY TCP4 1.2.3.4 5.6.7.8 1111\r\n"))
+	if _, err := readProxyHeaderV1(br); err != errNotProxyProto {
+		t.Fatalf("err = %v, want errNotProxyProto", err)
+	}
+}
+
+func TestReadProxyHeaderV1NotProxy(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))
+	if _, err := readProxyHeaderV1(br); err != errNotProxyProto {
+		t.Fatalf("err = %v, want errNotProxyProto", err)
+	}
+}
+
+func TestReadProxyHeaderV1BadSourceAddr(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("PROXY TCP4 not-an-ip 5.6.7.8 1111 2222\r\n"))
+	if _, err := readProxyHeaderV1(br); err == nil {
+		t.Fatal("err = nil, want a parse error for the bad source address")
+	}
+}
+
+func TestReadProxyHeaderV1ShortRead(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222")) // no trailing \r\n
+	if _, err := readProxyHeaderV1(br); err == nil {
+		t.Fatal("err = nil, want a read error for the missing line terminator")
+	}
+}
+
+// proxyHeaderV2 builds a raw PROXY v2 header: signature + version/command +
+// family byte + addrLen + body.
+func proxyHeaderV2(family byte, body []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyProtoV2Sig)
+	buf.WriteByte(proxyProtoVersionCmd)
+	buf.WriteByte(family)
+	binary.Write(&buf, binary.BigEndian, uint16(len(body)))
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func TestReadProxyHeaderV2IPv4(t *testing.T) {
+	body := make([]byte, 12)
+	copy(body[0:4], net.ParseIP("10.0.0.1").To4())
+	copy(body[4:8], net.ParseIP("10.0.0.2").To4())
+	binary.BigEndian.PutUint16(body[8:10], 1234)
+	binary.BigEndian.PutUint16(body[10:12], 443)
+
+	br := bufio.NewReader(bytes.NewReader(proxyHeaderV2(proxyProtoFamilyIPv4, body)))
+	addr, err := readProxyHeaderV2(br)
+	if err != nil {
+		t.Fatalf("readProxyHeaderV2: %v", err)
+	}
+	if addr.IP.String() != "10.0.0.1" || addr.Port != 1234 {
+		t.Errorf("addr = %+v, want 10.0.0.1:1234", addr)
+	}
+}
+
+func TestReadProxyHeaderV2IPv6(t *testing.T) {
+	body := make([]byte, 36)
+	copy(body[0:16], net.ParseIP("2001:db8::1").To16())
+	copy(body[16:32], net.ParseIP("2001:db8::2").To16())
+	binary.BigEndian.PutUint16(body[32:34], 5555)
+	binary.BigEndian.PutUint16(body[34:36], 443)
+
+	br := bufio.NewReader(bytes.NewReader(proxyHeaderV2(proxyProtoFamilyIPv6, body)))
+	addr, err := readProxyHeaderV2(br)
+	if err != nil {
+		t.Fatalf("readProxyHeaderV2: %v", err)
+	}
+	if addr.IP.String() != "2001:db8::1" || addr.Port != 5555 {
+		t.Errorf("addr = %+v, want [2001:db8::1]:5555", addr)
+	}
+}
+
+func TestReadProxyHeaderV2UnknownFamily(t *testing.T) {
+	// AF_UNSPEC/LOCAL: no address to recover, not an error.
+	br := bufio.NewReader(bytes.NewReader(proxyHeaderV2(0x00, nil)))
+	addr, err := readProxyHeaderV2(br)
+	if err != nil {
+		t.Fatalf("readProxyHeaderV2: %v", err)
+	}
+	if addr != nil {
+		t.Errorf("addr = %+v, want nil", addr)
+	}
+}
+
+func TestReadProxyHeaderV2ShortIPv4Body(t *testing.T) {
+	// addrLen claims only 4 bytes, too short for the 12-byte IPv4 address
+	// block readProxyHeaderV2 expects.
+	br := bufio.NewReader(bytes.NewReader(proxyHeaderV2(proxyProtoFamilyIPv4, make([]byte, 4))))
+	if _, err := readProxyHeaderV2(br); err != errNotProxyProto {
+		t.Fatalf("err = %v, want errNotProxyProto", err)
+	}
+}
+
+func TestReadProxyHeaderV2BadVersionCmd(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(proxyProtoV2Sig)
+	buf.WriteByte(0x11) // version 1, not the supported version 2 / PROXY command
+	buf.WriteByte(proxyProtoFamilyIPv4)
+	binary.Write(&buf, binary.BigEndian, uint16(0))
+
+	br := bufio.NewReader(bytes.NewReader(buf.Bytes()))
+	if _, err := readProxyHeaderV2(br); err == nil {
+		t.Fatal("err = nil, want an unsupported version/command error")
+	}
+}
+
+func TestReadProxyHeaderV2ShortRead(t *testing.T) {
+	// Not even a full 16-byte fixed header.
+	br := bufio.NewReader(bytes.NewReader(proxyProtoV2Sig))
+	if _, err := readProxyHeaderV2(br); err == nil {
+		t.Fatal("err = nil, want a read error for the truncated header")
+	}
+}
+
+func TestPeekClientAddrNoHeader(t *testing.T) {
+	addr, br, err := peekClientAddr(strings.NewReader("GET / HTTP/1.1\r\n"))
+	if err != nil {
+		t.Fatalf("peekClientAddr: %v", err)
+	}
+	if addr != nil {
+		t.Errorf("addr = %+v, want nil", addr)
+	}
+	line, _ := br.ReadString('\n')
+	if line != "GET / HTTP/1.1\r\n" {
+		t.Errorf("br yielded %q, want the original request line unconsumed", line)
+	}
+}
+
+func TestPeekClientAddrV1(t *testing.T) {
+	addr, _, err := peekClientAddr(strings.NewReader("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\nGET / HTTP/1.1\r\n"))
+	if err != nil {
+		t.Fatalf("peekClientAddr: %v", err)
+	}
+	if addr == nil || addr.IP.String() != "1.2.3.4" {
+		t.Errorf("addr = %+v, want 1.2.3.4:1111", addr)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rproxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// rule maps a hostname glob, e.g. "*.example.com", to a backend address.
+type rule struct {
+	pattern string
+	backend string
+}
+
+// Router holds the hostname-glob -> backend table used by a "sni" listener.
+// It is safe for concurrent use; Reload swaps the table under lock so
+// in-flight lookups never see a half-updated ruleset.
+type Router struct {
+	mu    sync.RWMutex
+	rules []rule
+	def   string
+	path  string
+}
+
+// LoadRouter reads the routing rules from path. Each non-empty,
+// non-comment line is either:
+//
+//	default <backend-addr>
+//	<hostname-glob> <backend-addr>
+//
+// Lines starting with '#' are comments. The default directive, if present,
+// is used when no glob matches the SNI hostname.
+func LoadRouter(configPath string) (*Router, error) {
+	r := &Router{path: configPath}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the router's config file and swaps in the new rules.
+// It is safe to call while Match is being invoked from other goroutines.
+func (r *Router) Reload() error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rules []rule
+	var def string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("sni: malformed routing rule %q", line)
+		}
+		if fields[0] == "default" {
+			def = fields[1]
+			continue
+		}
+		rules = append(rules, rule{pattern: fields[0], backend: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.rules = rules
+	r.def = def
+	r.mu.Unlock()
+	return nil
+}
+
+// Match returns the backend address for serverName, falling back to the
+// configured default route. It returns "" if there is no match and no
+// default.
+func (r *Router) Match(serverName string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rl := range r.rules {
+		if ok, _ := path.Match(rl.pattern, serverName); ok {
+			return rl.backend
+		}
+	}
+	return r.def
+}
@@ -17,14 +17,22 @@
 package rproxy
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/timofonic-comms/go-rproxy/rproxy/sni"
 )
 
 type RProxy struct {
@@ -37,10 +45,59 @@ type RProxy struct {
 	serverKey    string
 	clientCert   string
 	clientKey    string
+
+	// router is only set when listenProto is "sni"; it picks the backend
+	// for each connection from the ClientHello's server_name.
+	router *Router
+
+	// PROXY protocol v2 options, see WithAcceptProxyProto,
+	// WithSendProxyProto and WithProxyProtoTLVs.
+	acceptProxyProto bool
+	sendProxyProto   bool
+	proxyProtoTLVs   bool
+
+	// certProvider supplies the TLS listener's certificate; if nil,
+	// startTLS falls back to loading serverCert/serverKey once. Set via
+	// WithCertProvider.
+	certProvider CertProvider
+
+	// ManagedNames is pre-warmed by Start() when certProvider is set, so
+	// the first real connection for a known hostname doesn't pay the
+	// cost of an ACME order.
+	ManagedNames []string
+
+	// mitmCA and mitmBackendPort are only set when listenProto is "mitm";
+	// see NewMITMRProxy.
+	mitmCA          *MITMCertProvider
+	mitmBackendPort string
+
+	// Interceptor, if set, is invoked with the dumped bytes of each
+	// HTTP/1.1 request and response observed in "mitm" mode.
+	Interceptor Interceptor
+
+	// trackConn, if set, wraps every accepted connection before it is
+	// served; Server uses it to maintain its Conns set. Set via
+	// WithConnTracker.
+	trackConn func(net.Conn) net.Conn
+
+	// metrics and logger are optional observability hooks; see
+	// WithMetrics and WithLogger. logger defaults to a JSONLogger writing
+	// to os.Stdout.
+	metrics *Metrics
+	logger  Logger
+
+	listener net.Listener
+	closing  int32 // set by Stop; read with atomic
+
+	// hup and hupDone are only set when listenProto is "sni"; Stop uses
+	// them to tear down the SIGHUP-triggered router-reload goroutine
+	// started by startSNI.
+	hup     chan os.Signal
+	hupDone chan struct{}
 }
 
-func NewRProxy(listenProto, listenAddr, backendProto, backendAddr, rootCert, serverCert, serverKey, clientCert, clientKey string) *RProxy {
-	return &RProxy{
+func NewRProxy(listenProto, listenAddr, backendProto, backendAddr, rootCert, serverCert, serverKey, clientCert, clientKey string, opts ...Option) *RProxy {
+	rp := &RProxy{
 		listenProto:  strings.ToLower(listenProto),
 		listenAddr:   strings.ToLower(listenAddr),
 		backendProto: strings.ToLower(backendProto),
@@ -51,127 +108,360 @@ func NewRProxy(listenProto, listenAddr, backendProto, backendAddr, rootCert, ser
 		clientCert:   clientCert,
 		clientKey:    clientKey,
 	}
+	for _, opt := range opts {
+		opt(rp)
+	}
+	return rp
+}
+
+// NewSNIRProxy creates an RProxy that fronts many backends on a single TLS
+// listener, picking the backend per-connection by matching the ClientHello
+// SNI hostname against the rules in configPath (see LoadRouter). Send the
+// process SIGHUP to reload configPath without restarting the listener.
+func NewSNIRProxy(listenAddr, configPath string, opts ...Option) (*RProxy, error) {
+	router, err := LoadRouter(configPath)
+	if err != nil {
+		return nil, err
+	}
+	rp := &RProxy{
+		listenProto: "sni",
+		listenAddr:  strings.ToLower(listenAddr),
+		router:      router,
+	}
+	for _, opt := range opts {
+		opt(rp)
+	}
+	return rp, nil
 }
 
-func (rp *RProxy) Start() {
+// Start runs rp's listener, blocking until it is stopped or fails. Callers
+// that want to keep running after a listener fails should log the returned
+// error themselves, typically from a goroutine (see Server.apply).
+func (rp *RProxy) Start() error {
+	if rp.logger == nil {
+		rp.logger = &JSONLogger{}
+	}
+	if rp.certProvider != nil {
+		rp.warmManagedNames()
+	}
 	switch rp.listenProto {
 	case "tcp":
-		rp.startTCP()
+		return rp.startTCP()
 	case "tls":
-		rp.startTLS()
+		return rp.startTLS()
+	case "sni":
+		return rp.startSNI()
+	case "mitm":
+		return rp.startMITM()
 	default:
-		panic("listen protocol not supported")
+		return fmt.Errorf("rproxy: listen protocol %q not supported", rp.listenProto)
+	}
+}
+
+// warmManagedNames asks certProvider for a certificate for each
+// pre-declared hostname before the listener starts accepting, so the
+// first client doesn't pay for cert issuance inline.
+func (rp *RProxy) warmManagedNames() {
+	for _, name := range rp.ManagedNames {
+		if _, err := rp.certProvider.GetCertificate(&tls.ClientHelloInfo{ServerName: name}); err != nil {
+			log.Printf("failed to pre-warm certificate for %q (%v)\n", name, err)
+		}
+	}
+}
+
+// acceptLoop stores ln so Stop can interrupt it, then runs handle for
+// every accepted connection (after wrapping it with trackConn, if set) in
+// its own goroutine, until the listener is closed.
+func (rp *RProxy) acceptLoop(ln net.Listener, handle func(net.Conn)) error {
+	rp.listener = ln
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&rp.closing) == 1 {
+				return nil
+			}
+			log.Printf("accept error (%v)\n", err)
+			continue
+		}
+		if rp.metrics != nil {
+			rp.metrics.IncAccepted()
+		}
+		if rp.trackConn != nil {
+			conn = rp.trackConn(conn)
+		}
+		go handle(conn)
+	}
+}
+
+// Stop closes rp's listener so it stops accepting new connections;
+// connections already being served are left running. It is safe to call
+// concurrently with Start, and is how Server reloads a changed frontend
+// without dropping in-flight traffic.
+func (rp *RProxy) Stop() {
+	atomic.StoreInt32(&rp.closing, 1)
+	if rp.listener != nil {
+		rp.listener.Close()
+	}
+	if rp.hup != nil {
+		signal.Stop(rp.hup)
+		close(rp.hupDone)
+	}
+	// certProvider (e.g. *acme.Provider) may have started its own
+	// background goroutines keyed by hostname (renewals); give it a
+	// chance to cancel them so a reload/removal doesn't leave them
+	// running for a frontend nobody serves anymore.
+	if stopper, ok := rp.certProvider.(interface{ Stop() }); ok {
+		stopper.Stop()
 	}
 }
 
 func (rp *RProxy) serve(conn net.Conn) error {
 	switch rp.backendProto {
 	case "tcp":
-		rp.serveTCP(conn)
+		return rp.serveTCP(conn)
 	case "tls":
-		rp.serveTLS(conn)
+		return rp.serveTLS(conn)
 	default:
-		panic("backend protocol not supported")
+		return fmt.Errorf("rproxy: backend protocol %q not supported", rp.backendProto)
 	}
-	return nil
 }
 
-func (rp *RProxy) startTCP() {
+func (rp *RProxy) startTCP() error {
 	// Resolve network address
 	lAddr, err := net.ResolveTCPAddr("tcp", rp.listenAddr)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	// Listen to TCP connections
 	ln, err := net.ListenTCP("tcp", lAddr)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer ln.Close()
-	// Handle connections
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Printf("accept error (%v)\n", err)
-			continue
+	return rp.acceptLoop(ln, func(conn net.Conn) {
+		if rp.acceptProxyProto {
+			addr, br, err := peekClientAddr(conn)
+			if err != nil {
+				log.Printf("proxy protocol error (%v)\n", err)
+				conn.Close()
+				return
+			}
+			conn = &proxyConn{Conn: conn, r: br, clientAddr: addr}
 		}
-		go rp.serve(conn)
-	}
+		if err := rp.serve(conn); err != nil {
+			log.Printf("serve error (%v)\n", err)
+		}
+	})
 }
 
-func (rp *RProxy) startTLS() {
+func (rp *RProxy) startTLS() error {
 	// Load root pem
 	rootPEM, err := ioutil.ReadFile(rp.rootCert)
 	if err != nil {
-		panic("failed to load root certificate")
+		return fmt.Errorf("failed to load root certificate: %w", err)
 	}
 	roots := x509.NewCertPool()
 	if ok := roots.AppendCertsFromPEM([]byte(rootPEM)); !ok {
-		panic("failed to parse root certificate")
+		return fmt.Errorf("failed to parse root certificate")
 	}
-	// Load server pem
-	cert, err := tls.LoadX509KeyPair(rp.serverCert, rp.serverKey)
-	if err != nil {
-		log.Fatalf("failed to load server tls certificate: %s", err)
+	// Fall back to the fixed serverCert/serverKey pair unless a pluggable
+	// CertProvider (e.g. rproxy/acme.Provider) was supplied.
+	if rp.certProvider == nil {
+		provider, err := NewFileCertProvider(rp.serverCert, rp.serverKey)
+		if err != nil {
+			return fmt.Errorf("failed to load server tls certificate: %w", err)
+		}
+		rp.certProvider = provider
 	}
 	// Set config for TLS listener
 	config := tls.Config{
-		ClientCAs:    roots,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		Certificates: []tls.Certificate{cert},
+		ClientCAs:      roots,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		GetCertificate: rp.certProvider.GetCertificate,
 	}
-	// Listen to TLS connections
-	ln, err := tls.Listen("tcp", rp.listenAddr, &config)
+	if alpn, ok := rp.certProvider.(interface{ ALPNProtos() []string }); ok {
+		config.NextProtos = append(config.NextProtos, alpn.ALPNProtos()...)
+	}
+	// Listen to raw TCP connections; TLS is terminated below rather than by
+	// tls.Listen, so an optional PROXY protocol header can be stripped off
+	// before the handshake begins.
+	lAddr, err := net.ResolveTCPAddr("tcp", rp.listenAddr)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer ln.Close()
-	// Handle connections
-	for {
-		conn, err := ln.Accept()
+	ln, err := net.ListenTCP("tcp", lAddr)
+	if err != nil {
+		return err
+	}
+	return rp.acceptLoop(ln, func(conn net.Conn) {
+		rp.acceptTLS(conn, &config)
+	})
+}
+
+// acceptTLS optionally strips a PROXY protocol header off rawConn, then
+// performs the TLS handshake and hands the result to serve. The client
+// address and post-handshake TLS state are captured in a proxyConn so the
+// backend leg can forward them in its own PROXY v2 header.
+func (rp *RProxy) acceptTLS(rawConn net.Conn, config *tls.Config) {
+	var conn net.Conn = rawConn
+	var clientAddr *net.TCPAddr
+	if rp.acceptProxyProto {
+		addr, br, err := peekClientAddr(rawConn)
 		if err != nil {
-			log.Printf("accept error (%v)\n", err)
-			continue
+			log.Printf("proxy protocol error (%v)\n", err)
+			rawConn.Close()
+			return
 		}
-		go rp.serve(conn)
+		clientAddr = addr
+		conn = &proxyConn{Conn: rawConn, r: br, clientAddr: addr}
 	}
+
+	tlsConn := tls.Server(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("handshake error (%v)\n", err)
+		if rp.metrics != nil {
+			rp.metrics.IncHandshakeFailure()
+		}
+		tlsConn.Close()
+		return
+	}
+	// tlsConn's own underlying conn is the pre-handshake proxyConn (or
+	// rawConn), so wrap tlsConn itself rather than mutating that proxyConn
+	// in place — pc.Conn = tlsConn would make pc.Read call tlsConn.Read,
+	// which reads from its underlying conn (pc), recursing forever.
+	state := tlsConn.ConnectionState()
+	pc := &proxyConn{Conn: tlsConn, clientAddr: clientAddr, state: &state}
+	if err := rp.serve(pc); err != nil {
+		log.Printf("serve error (%v)\n", err)
+	}
+}
+
+func (rp *RProxy) startSNI() error {
+	// Resolve network address
+	lAddr, err := net.ResolveTCPAddr("tcp", rp.listenAddr)
+	if err != nil {
+		return err
+	}
+	// Listen to TCP connections; TLS is never terminated here, only peeked.
+	ln, err := net.ListenTCP("tcp", lAddr)
+	if err != nil {
+		return err
+	}
+
+	// Reload the routing table on SIGHUP without dropping the listener.
+	// Stop tears this down via rp.hup/rp.hupDone so reloading a removed
+	// frontend doesn't leak the goroutine forever.
+	rp.hup = make(chan os.Signal, 1)
+	rp.hupDone = make(chan struct{})
+	signal.Notify(rp.hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-rp.hup:
+				if err := rp.router.Reload(); err != nil {
+					log.Printf("sni: reload error (%v)\n", err)
+				}
+			case <-rp.hupDone:
+				return
+			}
+		}
+	}()
+
+	return rp.acceptLoop(ln, func(conn net.Conn) {
+		if err := rp.serveSNI(conn); err != nil {
+			log.Printf("sni: serve error (%v)\n", err)
+		}
+	})
+}
+
+func (rp *RProxy) serveSNI(listenConn net.Conn) error {
+	start := time.Now()
+	serverName, buffered, err := sni.ReadClientHello(listenConn)
+	switch err {
+	case nil:
+	case sni.ErrNotHandshake, sni.ErrNotClientHello, sni.ErrTruncated:
+		// The handshake didn't parse as a well-formed, single-record
+		// ClientHello, but every byte we read is still in buffered;
+		// fall through and route on the (empty) serverName.
+	default:
+		// A genuine I/O error reading the handshake: close rather than
+		// splice partial/corrupted bytes to a backend.
+		listenConn.Close()
+		return err
+	}
+	if rp.metrics != nil {
+		rp.metrics.IncSNIConn(serverName)
+	}
+
+	backendAddr := rp.router.Match(serverName)
+	if backendAddr == "" {
+		listenConn.Close()
+		return fmt.Errorf("sni: no route for %q", serverName)
+	}
+
+	dialStart := time.Now()
+	backendConn, err := net.DialTimeout("tcp", backendAddr, 30*time.Second)
+	if rp.metrics != nil {
+		rp.metrics.ObserveDialLatency(time.Since(dialStart))
+	}
+	if err != nil {
+		listenConn.Close()
+		return err
+	}
+	// Splice the already-consumed ClientHello bytes back onto the front of
+	// the client stream so the backend sees the handshake it expects.
+	client := io.MultiReader(bytes.NewReader(buffered), listenConn)
+
+	bytesUp, bytesDown, reason := rp.pipe(backendConn, listenConn, client)
+	rp.logClose(listenConn, serverName, "", "", backendAddr, time.Since(start), bytesUp, bytesDown, reason)
+	return nil
 }
 
 func (rp *RProxy) serveTCP(listenConn net.Conn) error {
+	start := time.Now()
 	// Dial to the backend server
+	dialStart := time.Now()
 	backendConn, err := net.DialTimeout("tcp", rp.backendAddr, 30*time.Second)
+	if rp.metrics != nil {
+		rp.metrics.ObserveDialLatency(time.Since(dialStart))
+	}
 	if err != nil {
 		listenConn.Close()
 		return err
 	}
-	// Copy network traffic from the listen connection to backend connection
-	go func() {
-		io.Copy(backendConn, listenConn)
-		backendConn.Close()
-		listenConn.Close()
-	}()
-	// Copy network traffic from the backend connection to listen connection
-	io.Copy(listenConn, backendConn)
-	backendConn.Close()
-	listenConn.Close()
+	if rp.sendProxyProto {
+		if err := rp.writeProxyHeader(backendConn, listenConn, ""); err != nil {
+			log.Printf("proxy protocol write error (%v)\n", err)
+			backendConn.Close()
+			listenConn.Close()
+			return err
+		}
+	}
+
+	bytesUp, bytesDown, reason := rp.pipe(backendConn, listenConn, listenConn)
+	rp.logClose(listenConn, "", "", "", rp.backendAddr, time.Since(start), bytesUp, bytesDown, reason)
 	return nil
 }
 
 func (rp *RProxy) serveTLS(listenConn net.Conn) error {
+	start := time.Now()
 	// Load root pem
 	rootPEM, err := ioutil.ReadFile(rp.rootCert)
 	if err != nil {
-		log.Fatalf("failed to load root certificate")
+		listenConn.Close()
+		return fmt.Errorf("failed to load root certificate: %w", err)
 	}
 	roots := x509.NewCertPool()
 	if ok := roots.AppendCertsFromPEM([]byte(rootPEM)); !ok {
-		panic("failed to parse root certificate")
+		listenConn.Close()
+		return fmt.Errorf("failed to parse root certificate")
 	}
 
 	// Load client pem
 	cert, err := tls.LoadX509KeyPair(rp.clientCert, rp.clientKey)
 	if err != nil {
-		panic("failed to load client tls certificate")
+		listenConn.Close()
+		return fmt.Errorf("failed to load client tls certificate: %w", err)
 	}
 	// Set config for TLS connections
 	config := tls.Config{
@@ -180,20 +470,84 @@ func (rp *RProxy) serveTLS(listenConn net.Conn) error {
 		Certificates: []tls.Certificate{cert},
 	}
 	// Dial to the beckend server
+	dialStart := time.Now()
 	backendConn, err := tls.Dial("tcp", rp.backendAddr, &config)
+	if rp.metrics != nil {
+		rp.metrics.ObserveDialLatency(time.Since(dialStart))
+	}
 	if err != nil {
 		listenConn.Close()
 		return err
 	}
-	// Copy network traffic from the listen connection to backend connection
+	if rp.sendProxyProto {
+		if err := rp.writeProxyHeader(backendConn, listenConn, ""); err != nil {
+			log.Printf("proxy protocol write error (%v)\n", err)
+			backendConn.Close()
+			listenConn.Close()
+			return err
+		}
+	}
+
+	bytesUp, bytesDown, reason := rp.pipe(backendConn, listenConn, listenConn)
+	rp.logClose(listenConn, "", "", "", rp.backendAddr, time.Since(start), bytesUp, bytesDown, reason)
+	return nil
+}
+
+// pipe splices client (the data to send to the backend, which may differ
+// from listenConn when bytes were already peeked off it) and backendConn
+// in both directions; as soon as either direction ends, both connections
+// are closed, which ends the other. Byte totals are reported to
+// rp.metrics if set. It always closes both connections before returning.
+func (rp *RProxy) pipe(backendConn, listenConn net.Conn, client io.Reader) (bytesUp, bytesDown uint64, reason string) {
+	done := make(chan uint64, 1)
 	go func() {
-		io.Copy(backendConn, listenConn)
+		n, _ := io.Copy(backendConn, client)
 		backendConn.Close()
 		listenConn.Close()
+		done <- uint64(n)
 	}()
-	// Copy network traffic from the backend connection to listen connection
-	io.Copy(listenConn, backendConn)
+	n, _ := io.Copy(listenConn, backendConn)
+	bytesDown = uint64(n)
 	backendConn.Close()
 	listenConn.Close()
-	return nil
-}
\ No newline at end of file
+	bytesUp = <-done
+
+	if rp.metrics != nil {
+		rp.metrics.AddBytes(bytesUp, bytesDown)
+	}
+	return bytesUp, bytesDown, "closed"
+}
+
+// logClose reports one finished connection to rp.logger, filling in SNI,
+// ALPN and cipher from the listen leg's captured TLS state when the
+// caller didn't already know them.
+func (rp *RProxy) logClose(listenConn net.Conn, sniName, alpn, cipher, backendAddr string, duration time.Duration, bytesUp, bytesDown uint64, reason string) {
+	if rp.logger == nil {
+		return
+	}
+	clientAddr, state := proxyMeta(listenConn)
+	if sniName == "" && state != nil {
+		sniName = state.ServerName
+	}
+	if alpn == "" && state != nil {
+		alpn = state.NegotiatedProtocol
+	}
+	if cipher == "" && state != nil {
+		cipher = tls.CipherSuiteName(state.CipherSuite)
+	}
+	var addr string
+	if clientAddr != nil {
+		addr = clientAddr.String()
+	}
+	rp.logger.LogConn(ConnRecord{
+		ClientAddr:  addr,
+		SNI:         sniName,
+		ALPN:        alpn,
+		Cipher:      cipher,
+		BackendAddr: backendAddr,
+		Duration:    duration,
+		BytesUp:     bytesUp,
+		BytesDown:   bytesDown,
+		CloseReason: reason,
+	})
+}
@@ -0,0 +1,233 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/timofonic-comms/go-rproxy/rproxy/acme"
+)
+
+// trackedConn removes itself from its owning Server's Conns set when
+// closed, so Conns always reflects connections still in flight.
+type trackedConn struct {
+	net.Conn
+	server *Server
+}
+
+func (c *trackedConn) Close() error {
+	c.server.untrack(c)
+	return c.Conn.Close()
+}
+
+type frontendState struct {
+	rp *RProxy
+	fc FrontendConfig
+}
+
+// Server manages the set of RProxy frontends declared by a config file,
+// starting and stopping them as the file changes. Unlike a single
+// NewRProxy-built RProxy, it supports reloading on SIGHUP without
+// dropping in-flight connections: a changed or removed frontend's
+// listener is closed immediately (acceptLoop exits after Stop), but its
+// already-accepted connections keep running, tracked in Conns, until they
+// finish on their own or Shutdown forces them closed.
+type Server struct {
+	configPath string
+
+	mu        sync.Mutex
+	frontends map[string]*frontendState
+
+	connsMu sync.Mutex
+	Conns   map[*trackedConn]struct{}
+}
+
+// NewServer loads configPath and starts every frontend it declares.
+func NewServer(configPath string) (*Server, error) {
+	s := &Server{
+		configPath: configPath,
+		frontends:  make(map[string]*frontendState),
+		Conns:      make(map[*trackedConn]struct{}),
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.apply(cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ListenAndServe blocks, reloading the frontend set from configPath every
+// time the process receives SIGHUP.
+func (s *Server) ListenAndServe() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		cfg, err := LoadConfig(s.configPath)
+		if err != nil {
+			log.Printf("server: reload %s: %v\n", s.configPath, err)
+			continue
+		}
+		if err := s.apply(cfg); err != nil {
+			log.Printf("server: apply reloaded config: %v\n", err)
+		}
+	}
+}
+
+func (s *Server) track(c net.Conn) net.Conn {
+	tc := &trackedConn{Conn: c, server: s}
+	s.connsMu.Lock()
+	s.Conns[tc] = struct{}{}
+	s.connsMu.Unlock()
+	return tc
+}
+
+func (s *Server) untrack(c *trackedConn) {
+	s.connsMu.Lock()
+	delete(s.Conns, c)
+	s.connsMu.Unlock()
+}
+
+// apply starts frontends newly present in cfg, stops ones no longer
+// present, and restarts ones whose definition changed. Frontends whose
+// definition is unchanged, and their in-flight connections, are left
+// running untouched. A frontend that fails to build (e.g. a transient
+// ACME directory fetch error) doesn't stop the rest of cfg.Frontends from
+// being applied, or the removal pass from running; its error is reported
+// alongside any others once every frontend has been considered.
+func (s *Server) apply(cfg *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []string
+	seen := make(map[string]bool, len(cfg.Frontends))
+	for _, fc := range cfg.Frontends {
+		seen[fc.Name] = true
+		if old, ok := s.frontends[fc.Name]; ok && reflect.DeepEqual(old.fc, fc) {
+			continue
+		}
+
+		rp, err := newRProxyFromFrontend(fc, s.track)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("frontend %q: %v", fc.Name, err))
+			continue
+		}
+		if old, ok := s.frontends[fc.Name]; ok {
+			old.rp.Stop()
+		}
+		s.frontends[fc.Name] = &frontendState{rp: rp, fc: fc}
+		name := fc.Name
+		go func() {
+			if err := rp.Start(); err != nil {
+				log.Printf("server: frontend %q: %v\n", name, err)
+			}
+		}()
+	}
+	for name, st := range s.frontends {
+		if !seen[name] {
+			st.rp.Stop()
+			delete(s.frontends, name)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("server: apply config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Shutdown stops every frontend from accepting new connections, then
+// waits up to timeout for tracked connections to finish on their own
+// before forcibly closing whatever remains.
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.mu.Lock()
+	for _, st := range s.frontends {
+		st.rp.Stop()
+	}
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		s.connsMu.Lock()
+		remaining := len(s.Conns)
+		s.connsMu.Unlock()
+		if remaining == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	s.connsMu.Lock()
+	for c := range s.Conns {
+		c.Conn.Close()
+	}
+	s.connsMu.Unlock()
+}
+
+// newRProxyFromFrontend builds the RProxy described by fc, wiring track
+// in via WithConnTracker so Server can keep its Conns set up to date.
+func newRProxyFromFrontend(fc FrontendConfig, track func(net.Conn) net.Conn) (*RProxy, error) {
+	// PROXY protocol support is only wired into the "tcp" and "tls"
+	// listen/serve paths; serveSNI, acceptMITM and serveMITM never look
+	// at acceptProxyProto/sendProxyProto/proxyProtoTLVs, so silently
+	// accepting them here would make the config a no-op instead of an
+	// error.
+	if (fc.Mode == "sni" || fc.Mode == "mitm") && (fc.AcceptProxyProto || fc.SendProxyProto || fc.ProxyProtoTLVs) {
+		return nil, fmt.Errorf("frontend %q: PROXY protocol options are not supported in %q mode", fc.Name, fc.Mode)
+	}
+
+	opts := []Option{WithConnTracker(track)}
+	if fc.AcceptProxyProto {
+		opts = append(opts, WithAcceptProxyProto(true))
+	}
+	if fc.SendProxyProto {
+		opts = append(opts, WithSendProxyProto(true))
+	}
+	if fc.ProxyProtoTLVs {
+		opts = append(opts, WithProxyProtoTLVs(true))
+	}
+
+	switch fc.Mode {
+	case "tcp", "tls":
+		if fc.Mode == "tls" && fc.ACMEDirectory != "" {
+			store := &acme.FileCertStore{Dir: fc.ACMECertDir}
+			provider, err := acme.NewProvider(fc.ACMEDirectory, store)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, WithCertProvider(provider))
+		}
+		rp := NewRProxy(fc.Mode, fc.Listen, fc.BackendProto, fc.Backend,
+			fc.RootCert, fc.ServerCert, fc.ServerKey, fc.ClientCert, fc.ClientKey, opts...)
+		rp.ManagedNames = fc.ManagedNames
+		return rp, nil
+	case "sni":
+		return NewSNIRProxy(fc.Listen, fc.RouterConfig, opts...)
+	case "mitm":
+		return NewMITMRProxy(fc.Listen, fc.BackendPort, fc.CACert, fc.CAKey, nil, opts...)
+	default:
+		return nil, fmt.Errorf("unknown frontend mode %q", fc.Mode)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sni implements enough of the TLS record and handshake layer to
+// read the server_name extension out of a ClientHello without terminating
+// TLS, so the bytes can be re-spliced onto the connection afterwards.
+package sni
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	recordTypeHandshake   = 0x16
+	handshakeTypeClient   = 0x01
+	extensionServerName   = 0x0000
+	serverNameTypeDNSHost = 0x00
+)
+
+var (
+	ErrNotHandshake   = errors.New("sni: first record is not a TLS handshake")
+	ErrNotClientHello = errors.New("sni: handshake message is not a ClientHello")
+	ErrTruncated      = errors.New("sni: ClientHello is incomplete or spans multiple records")
+)
+
+// ReadClientHello reads the first TLS record from r, which must be a
+// complete ClientHello handshake message, and returns the server_name
+// extension value (if any) along with the raw bytes it consumed from r.
+// The caller is expected to splice buffered back onto the front of the
+// stream before handing the connection to a backend, e.g. with
+// io.MultiReader(bytes.NewReader(buffered), r).
+func ReadClientHello(r io.Reader) (serverName string, buffered []byte, err error) {
+	header := make([]byte, 5)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return "", nil, err
+	}
+	if header[0] != recordTypeHandshake {
+		return "", header, ErrNotHandshake
+	}
+	recordLen := int(binary.BigEndian.Uint16(header[3:5]))
+	record := make([]byte, recordLen)
+	n, readErr := io.ReadFull(r, record)
+	if readErr != nil {
+		// Keep whatever bytes were actually read (not the zero-filled
+		// tail) so a caller that ignores the error doesn't splice
+		// corrupted data onto the connection.
+		return "", append(header, record[:n]...), readErr
+	}
+	buffered = append(header, record...)
+
+	if len(record) < 4 || record[0] != handshakeTypeClient {
+		return "", buffered, ErrNotClientHello
+	}
+	msgLen := int(record[1])<<16 | int(record[2])<<8 | int(record[3])
+	body := record[4:]
+	if msgLen > len(body) {
+		// The ClientHello spilled into a second TLS record, which we
+		// don't reassemble; callers fall back to routing by default.
+		return "", buffered, ErrTruncated
+	}
+	body = body[:msgLen]
+
+	serverName, err = parseServerName(body)
+	return serverName, buffered, err
+}
+
+func parseServerName(body []byte) (string, error) {
+	// struct { ProtocolVersion; Random; SessionID; CipherSuites; CompressionMethods; Extensions } ClientHello
+	if len(body) < 2+32+1 {
+		return "", ErrTruncated
+	}
+	b := body[2+32:]
+
+	sessionIDLen := int(b[0])
+	b = b[1:]
+	if len(b) < sessionIDLen {
+		return "", ErrTruncated
+	}
+	b = b[sessionIDLen:]
+
+	if len(b) < 2 {
+		return "", ErrTruncated
+	}
+	cipherSuitesLen := int(binary.BigEndian.Uint16(b[:2]))
+	b = b[2:]
+	if len(b) < cipherSuitesLen {
+		return "", ErrTruncated
+	}
+	b = b[cipherSuitesLen:]
+
+	if len(b) < 1 {
+		return "", ErrTruncated
+	}
+	compressionLen := int(b[0])
+	b = b[1:]
+	if len(b) < compressionLen {
+		return "", ErrTruncated
+	}
+	b = b[compressionLen:]
+
+	if len(b) == 0 {
+		// No extensions, so no SNI was sent.
+		return "", nil
+	}
+	if len(b) < 2 {
+		return "", ErrTruncated
+	}
+	extensionsLen := int(binary.BigEndian.Uint16(b[:2]))
+	b = b[2:]
+	if len(b) < extensionsLen {
+		return "", ErrTruncated
+	}
+	extensions := b[:extensionsLen]
+
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions[:2])
+		extLen := int(binary.BigEndian.Uint16(extensions[2:4]))
+		extensions = extensions[4:]
+		if len(extensions) < extLen {
+			return "", ErrTruncated
+		}
+		extData := extensions[:extLen]
+		extensions = extensions[extLen:]
+
+		if extType != extensionServerName {
+			continue
+		}
+		return parseServerNameExtension(extData)
+	}
+	return "", nil
+}
+
+func parseServerNameExtension(data []byte) (string, error) {
+	if len(data) < 2 {
+		return "", ErrTruncated
+	}
+	listLen := int(binary.BigEndian.Uint16(data[:2]))
+	data = data[2:]
+	if len(data) < listLen {
+		return "", ErrTruncated
+	}
+	data = data[:listLen]
+
+	for len(data) >= 3 {
+		nameType := data[0]
+		nameLen := int(binary.BigEndian.Uint16(data[1:3]))
+		data = data[3:]
+		if len(data) < nameLen {
+			return "", ErrTruncated
+		}
+		name := data[:nameLen]
+		data = data[nameLen:]
+		if nameType == serverNameTypeDNSHost {
+			return string(bytes.ToLower(name)), nil
+		}
+	}
+	return "", nil
+}
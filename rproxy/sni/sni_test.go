@@ -0,0 +1,210 @@
+// Copyright 2016, Cong Ding. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sni
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// serverNameExtension builds the server_name extension body for a single
+// DNS hostname.
+func serverNameExtension(host string) []byte {
+	name := []byte(host)
+	var entry bytes.Buffer
+	entry.WriteByte(serverNameTypeDNSHost)
+	binary.Write(&entry, binary.BigEndian, uint16(len(name)))
+	entry.Write(name)
+
+	var ext bytes.Buffer
+	binary.Write(&ext, binary.BigEndian, uint16(entry.Len()))
+	ext.Write(entry.Bytes())
+	return ext.Bytes()
+}
+
+// clientHello builds a well-formed ClientHello handshake body, with the
+// server_name extension set to host when host != "".
+func clientHello(host string) []byte {
+	var body bytes.Buffer
+	body.Write(make([]byte, 2))                      // client_version
+	body.Write(make([]byte, 32))                     // random
+	body.WriteByte(0)                                // session_id_len
+	binary.Write(&body, binary.BigEndian, uint16(0)) // cipher_suites_len
+	body.WriteByte(0)                                // compression_methods_len
+
+	var extensions bytes.Buffer
+	if host != "" {
+		binary.Write(&extensions, binary.BigEndian, uint16(extensionServerName))
+		sni := serverNameExtension(host)
+		binary.Write(&extensions, binary.BigEndian, uint16(len(sni)))
+		extensions.Write(sni)
+	}
+	binary.Write(&body, binary.BigEndian, uint16(extensions.Len()))
+	body.Write(extensions.Bytes())
+
+	return body.Bytes()
+}
+
+// record wraps a ClientHello handshake body in its handshake header and
+// TLS record header, ready to hand to ReadClientHello.
+func record(body []byte) []byte {
+	var hs bytes.Buffer
+	hs.WriteByte(handshakeTypeClient)
+	hs.WriteByte(byte(len(body) >> 16))
+	hs.WriteByte(byte(len(body) >> 8))
+	hs.WriteByte(byte(len(body)))
+	hs.Write(body)
+
+	var rec bytes.Buffer
+	rec.WriteByte(recordTypeHandshake)
+	rec.Write([]byte{0x03, 0x03}) // TLS 1.2 record version
+	binary.Write(&rec, binary.BigEndian, uint16(hs.Len()))
+	rec.Write(hs.Bytes())
+	return rec.Bytes()
+}
+
+func TestReadClientHelloWithSNI(t *testing.T) {
+	data := record(clientHello("example.com"))
+	name, buffered, err := ReadClientHello(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadClientHello: %v", err)
+	}
+	if name != "example.com" {
+		t.Errorf("serverName = %q, want %q", name, "example.com")
+	}
+	if !bytes.Equal(buffered, data) {
+		t.Errorf("buffered = %x, want %x", buffered, data)
+	}
+}
+
+func TestReadClientHelloNoSNI(t *testing.T) {
+	data := record(clientHello(""))
+	name, _, err := ReadClientHello(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadClientHello: %v", err)
+	}
+	if name != "" {
+		t.Errorf("serverName = %q, want empty", name)
+	}
+}
+
+func TestReadClientHelloLowercasesName(t *testing.T) {
+	data := record(clientHello("Example.COM"))
+	name, _, err := ReadClientHello(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadClientHello: %v", err)
+	}
+	if name != "example.com" {
+		t.Errorf("serverName = %q, want %q", name, "example.com")
+	}
+}
+
+func TestReadClientHelloNotHandshake(t *testing.T) {
+	data := record(clientHello("example.com"))
+	data[0] = 0x17 // application_data
+	_, buffered, err := ReadClientHello(bytes.NewReader(data))
+	if err != ErrNotHandshake {
+		t.Fatalf("err = %v, want ErrNotHandshake", err)
+	}
+	if len(buffered) != 5 {
+		t.Errorf("buffered = %d bytes, want just the 5-byte record header", len(buffered))
+	}
+}
+
+func TestReadClientHelloNotClientHello(t *testing.T) {
+	body := clientHello("example.com")
+	var hs bytes.Buffer
+	hs.WriteByte(0x02) // ServerHello, not ClientHello
+	hs.WriteByte(byte(len(body) >> 16))
+	hs.WriteByte(byte(len(body) >> 8))
+	hs.WriteByte(byte(len(body)))
+	hs.Write(body)
+
+	var rec bytes.Buffer
+	rec.WriteByte(recordTypeHandshake)
+	rec.Write([]byte{0x03, 0x03})
+	binary.Write(&rec, binary.BigEndian, uint16(hs.Len()))
+	rec.Write(hs.Bytes())
+
+	_, _, err := ReadClientHello(bytes.NewReader(rec.Bytes()))
+	if err != ErrNotClientHello {
+		t.Fatalf("err = %v, want ErrNotClientHello", err)
+	}
+}
+
+func TestReadClientHelloSpansMultipleRecords(t *testing.T) {
+	body := clientHello("example.com")
+	var hs bytes.Buffer
+	hs.WriteByte(handshakeTypeClient)
+	// Claim a handshake message length larger than the body actually
+	// present in this record, as if it spilled into a second record.
+	bogusLen := len(body) + 16
+	hs.WriteByte(byte(bogusLen >> 16))
+	hs.WriteByte(byte(bogusLen >> 8))
+	hs.WriteByte(byte(bogusLen))
+	hs.Write(body)
+
+	var rec bytes.Buffer
+	rec.WriteByte(recordTypeHandshake)
+	rec.Write([]byte{0x03, 0x03})
+	binary.Write(&rec, binary.BigEndian, uint16(hs.Len()))
+	rec.Write(hs.Bytes())
+
+	_, _, err := ReadClientHello(bytes.NewReader(rec.Bytes()))
+	if err != ErrTruncated {
+		t.Fatalf("err = %v, want ErrTruncated", err)
+	}
+}
+
+func TestReadClientHelloOversizedExtension(t *testing.T) {
+	body := clientHello("example.com")
+	// The extensions_len field sits right after the fixed client_version,
+	// random, empty session_id/cipher_suites/compression fields: 2 + 32 +
+	// 1 + 2 + 1 = 38 bytes in. Bump it past the end of body.
+	const extLenOffset = 2 + 32 + 1 + 2 + 1
+	binary.BigEndian.PutUint16(body[extLenOffset:extLenOffset+2], 0xFFFF)
+
+	_, _, err := ReadClientHello(bytes.NewReader(record(body)))
+	if err != ErrTruncated {
+		t.Fatalf("err = %v, want ErrTruncated", err)
+	}
+}
+
+func TestReadClientHelloTruncatedRead(t *testing.T) {
+	data := record(clientHello("example.com"))
+	truncated := data[:len(data)-4]
+	_, buffered, err := ReadClientHello(bytes.NewReader(truncated))
+	if err == nil {
+		t.Fatal("err = nil, want a read error")
+	}
+	if err == io.EOF {
+		t.Fatalf("err = io.EOF, want io.ErrUnexpectedEOF (short, non-empty read)")
+	}
+	if len(buffered) != len(truncated) {
+		t.Errorf("buffered = %d bytes, want the %d bytes actually read", len(buffered), len(truncated))
+	}
+}
+
+func TestReadClientHelloEmptyInput(t *testing.T) {
+	_, buffered, err := ReadClientHello(bytes.NewReader(nil))
+	if err != io.EOF {
+		t.Fatalf("err = %v, want io.EOF", err)
+	}
+	if buffered != nil {
+		t.Errorf("buffered = %x, want nil", buffered)
+	}
+}